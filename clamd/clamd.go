@@ -0,0 +1,114 @@
+package clamd
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/jfyne/live"
+)
+
+const (
+	// defaultChunkSize the size of the chunks data is streamed in.
+	defaultChunkSize = 64 * 1024
+)
+
+var _ live.Scanner = &Scanner{}
+
+// Scanner scans uploads with clamd using its INSTREAM command, so the
+// data doesn't have to be somewhere clamd can read it.
+type Scanner struct {
+	// Network the network clamd listens on, tcp or unix.
+	Network string
+	// Address the address clamd listens on, for example
+	// localhost:3310 or /var/run/clamav/clamd.ctl.
+	Address string
+	// ChunkSize the size of the chunks data is streamed in. It must be
+	// less than clamd's StreamMaxLength.
+	ChunkSize int
+}
+
+// NewScanner create a scanner talking to clamd at address.
+func NewScanner(network, address string) *Scanner {
+	return &Scanner{
+		Network:   network,
+		Address:   address,
+		ChunkSize: defaultChunkSize,
+	}
+}
+
+// Scan stream an entry's data to clamd. It returns an error wrapping
+// live.ErrUploadInfected with the name of the signature if clamd finds
+// something.
+func (s *Scanner) Scan(ctx context.Context, entry *live.UploadEntry, r io.Reader) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, s.Network, s.Address)
+	if err != nil {
+		return fmt.Errorf("could not connect to clamd: %w", err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if err := s.stream(conn, r); err != nil {
+		return err
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("could not read clamd reply: %w", err)
+	}
+	return parseReply(reply)
+}
+
+// stream send data with the INSTREAM command, each chunk prefixed with
+// its length and ended by a zero length chunk.
+func (s *Scanner) stream(w io.Writer, r io.Reader) error {
+	if _, err := io.WriteString(w, "zINSTREAM\x00"); err != nil {
+		return fmt.Errorf("could not send command: %w", err)
+	}
+	size := s.ChunkSize
+	if size <= 0 {
+		size = defaultChunkSize
+	}
+	buf := make([]byte, 4+size)
+	for {
+		n, err := r.Read(buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf, uint32(n))
+			if _, werr := w.Write(buf[:4+n]); werr != nil {
+				return fmt.Errorf("could not send chunk: %w", werr)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("could not read upload: %w", err)
+		}
+	}
+	if _, err := w.Write([]byte{0, 0, 0, 0}); err != nil {
+		return fmt.Errorf("could not end stream: %w", err)
+	}
+	return nil
+}
+
+// parseReply turn clamd's reply into an error. Replies look like
+// "stream: OK", "stream: Eicar-Signature FOUND" or "... ERROR".
+func parseReply(reply string) error {
+	reply = strings.TrimRight(reply, "\x00\n")
+	result := strings.TrimSpace(strings.TrimPrefix(reply, "stream:"))
+	switch {
+	case result == "OK":
+		return nil
+	case strings.HasSuffix(result, " FOUND"):
+		return fmt.Errorf("%w: %s", live.ErrUploadInfected, strings.TrimSuffix(result, " FOUND"))
+	default:
+		return fmt.Errorf("clamd error: %s", reply)
+	}
+}
@@ -0,0 +1,239 @@
+package clamd
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jfyne/live"
+	"nhooyr.io/websocket"
+)
+
+const eicar = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+func newFake(t *testing.T) *Fake {
+	t.Helper()
+	f, err := NewFake()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(f.Close)
+	return f
+}
+
+func TestScan(t *testing.T) {
+	tests := []struct {
+		name      string
+		data      string
+		chunkSize int
+		want      error
+		signature string
+	}{
+		{name: "clean", data: "hello world, nothing to see here"},
+		{name: "empty", data: ""},
+		{name: "eicar", data: eicar, want: live.ErrUploadInfected, signature: "Eicar-Signature"},
+		{name: "eicar inside a file", data: "prefix " + eicar + " suffix", want: live.ErrUploadInfected, signature: "Eicar-Signature"},
+		// The signature is split across several chunks, which clamd
+		// has to put back together.
+		{name: "eicar split across chunks", data: "prefix " + eicar + " suffix", chunkSize: 7, want: live.ErrUploadInfected, signature: "Eicar-Signature"},
+		{name: "clean in small chunks", data: strings.Repeat("x", 100), chunkSize: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFake(t)
+			s := f.Scanner()
+			if tt.chunkSize > 0 {
+				s.ChunkSize = tt.chunkSize
+			}
+			err := s.Scan(context.Background(), nil, strings.NewReader(tt.data))
+			if tt.want == nil {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if !errors.Is(err, tt.want) || !strings.Contains(err.Error(), tt.signature) {
+				t.Fatalf("got %v, want %v with %s", err, tt.want, tt.signature)
+			}
+		})
+	}
+}
+
+func TestScanErrors(t *testing.T) {
+	f := newFake(t)
+	f.MaxLength = 10
+	err := f.Scanner().Scan(context.Background(), nil, strings.NewReader(strings.Repeat("x", 100)))
+	if err == nil || errors.Is(err, live.ErrUploadInfected) || !strings.Contains(err.Error(), "size limit exceeded") {
+		t.Fatalf("got %v, want a size limit error", err)
+	}
+	if n := f.Streams(); n != 0 {
+		t.Fatalf("%d streams scanned, want none", n)
+	}
+
+	closed := newFake(t)
+	closed.Close()
+	if err := closed.Scanner().Scan(context.Background(), nil, strings.NewReader("x")); err == nil {
+		t.Fatal("scanned with clamd down")
+	}
+}
+
+func TestStreamChunks(t *testing.T) {
+	s := &Scanner{ChunkSize: 4}
+	var buf bytes.Buffer
+	if err := s.stream(&buf, strings.NewReader("0123456789")); err != nil {
+		t.Fatal(err)
+	}
+	if cmd, _ := buf.ReadString(0); cmd != "zINSTREAM\x00" {
+		t.Fatalf("got command %q", cmd)
+	}
+	var chunks []string
+	for {
+		var size [4]byte
+		if _, err := io.ReadFull(&buf, size[:]); err != nil {
+			t.Fatal(err)
+		}
+		n := binary.BigEndian.Uint32(size[:])
+		if n == 0 {
+			break
+		}
+		chunks = append(chunks, string(buf.Next(int(n))))
+	}
+	if got := strings.Join(chunks, ","); got != "0123,4567,89" {
+		t.Fatalf("got chunks %s", got)
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("%d bytes after the end of the stream", buf.Len())
+	}
+}
+
+// TestScanUploads upload files to a live server scanning with clamd.
+// Anything clamd can't scan, such as a file over its size limit, is
+// refused as unscannable rather than let through.
+func TestScanUploads(t *testing.T) {
+	tests := []struct {
+		name      string
+		data      string
+		maxLength int
+		want      error
+	}{
+		{name: "clean", data: "hello world"},
+		{name: "infected", data: "prefix " + eicar, want: live.ErrUploadInfected},
+		{name: "over the size limit", data: strings.Repeat("x", 100), maxLength: 10, want: live.ErrUploadUnscannable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFake(t)
+			f.MaxLength = tt.maxLength
+			entry, cancelled := upload(t, f.Scanner(), tt.data)
+			if tt.want == nil {
+				if entry.Error != nil || !entry.Done || cancelled {
+					t.Fatalf("got done %t with %v, cancelled %t", entry.Done, entry.Error, cancelled)
+				}
+				return
+			}
+			if !errors.Is(entry.Error, tt.want) || !cancelled {
+				t.Fatalf("got %v, cancelled %t, want %v", entry.Error, cancelled, tt.want)
+			}
+		})
+	}
+}
+
+// upload send data as a single chunk to a live server scanning with
+// scanner. Entries are scanned once the chunk has been acked, so it
+// returns the entry once it has been scanned, and whether the client
+// was told to stop sending it.
+func upload(t *testing.T, scanner live.Scanner, data string) (*live.UploadEntry, bool) {
+	t.Helper()
+	mounted := make(chan struct{}, 1)
+	scanned := make(chan *live.UploadEntry, 1)
+	h := live.NewHandler()
+	h.HandleMount(func(ctx context.Context, s live.Socket) (interface{}, error) {
+		s.Upload("file")
+		mounted <- struct{}{}
+		return nil, nil
+	})
+	h.HandleRender(func(ctx context.Context, data interface{}) (io.Reader, error) {
+		return strings.NewReader("<div></div>"), nil
+	})
+	h.HandleUploadProgress("file", func(ctx context.Context, s live.Socket, entry *live.UploadEntry) (interface{}, error) {
+		if entry.Done || entry.Error != nil {
+			scanned <- entry
+		}
+		return nil, nil
+	})
+	server := httptest.NewServer(live.NewHttpHandler(
+		live.NewCookieStore("session", []byte("secret")),
+		h,
+		live.WithUploadStore(live.NewMemoryUploadStore()),
+		live.WithUploadScanner(scanner),
+	))
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(server.URL, "http"), &websocket.DialOptions{HTTPClient: http.DefaultClient})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close(websocket.StatusNormalClosure, "")
+	select {
+	case <-mounted:
+	case <-ctx.Done():
+		t.Fatal("socket was not mounted")
+	}
+
+	chunk, err := json.Marshal(map[string]interface{}{
+		"file":  map[string]interface{}{"name": "a.txt", "Size": len(data), "type": "text/plain"},
+		"field": "file",
+		"ref":   "0",
+		"chunk": base64.StdEncoding.EncodeToString([]byte(data)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := json.Marshal(live.Event{T: live.EventUpload, ID: 1, Data: chunk})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Write(ctx, websocket.MessageText, msg); err != nil {
+		t.Fatal(err)
+	}
+
+	var entry *live.UploadEntry
+	select {
+	case entry = <-scanned:
+	case <-ctx.Done():
+		t.Fatal("entry was not scanned")
+	}
+	// The chunk is acked as soon as it has been written, a rejected
+	// entry is cancelled whenever its scan fails.
+	acked, cancelled := false, false
+	for !acked || (entry.Error != nil && !cancelled) {
+		_, d, err := c.Read(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var e live.Event
+		if err := json.Unmarshal(d, &e); err != nil {
+			t.Fatal(err)
+		}
+		switch e.T {
+		case live.EventError:
+			t.Fatalf("got error event %s", e.Data)
+		case live.EventUploadCancel:
+			cancelled = true
+		case live.EventAck:
+			acked = acked || e.ID == 1
+		}
+	}
+	return entry, cancelled
+}
@@ -0,0 +1,119 @@
+package clamd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/jfyne/live"
+)
+
+// Fake a minimal clamd for tests. It speaks the INSTREAM command on a
+// local TCP port and finds the EICAR test signature.
+type Fake struct {
+	// Addr the address the fake listens on.
+	Addr string
+	// MaxLength the largest stream accepted, like clamd's
+	// StreamMaxLength. Zero for no limit.
+	MaxLength int
+
+	listener net.Listener
+	wg       sync.WaitGroup
+
+	mu      sync.Mutex
+	streams int
+}
+
+// NewFake start a fake clamd on a random local port. Close it with
+// Close.
+func NewFake() (*Fake, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("could not listen: %w", err)
+	}
+	f := &Fake{Addr: l.Addr().String(), listener: l}
+	f.wg.Add(1)
+	go f.serve()
+	return f, nil
+}
+
+// Scanner returns a scanner pointing at this fake.
+func (f *Fake) Scanner() *Scanner {
+	return NewScanner("tcp", f.Addr)
+}
+
+// Streams returns the number of streams which have been scanned.
+func (f *Fake) Streams() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.streams
+}
+
+// Close stop the fake and wait for its connections to finish.
+func (f *Fake) Close() {
+	f.listener.Close()
+	f.wg.Wait()
+}
+
+func (f *Fake) serve() {
+	defer f.wg.Done()
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+		f.wg.Add(1)
+		go func() {
+			defer f.wg.Done()
+			defer conn.Close()
+			io.WriteString(conn, "stream: "+f.handle(conn)+"\x00")
+		}()
+	}
+}
+
+// handle read a command and its stream, returning the result.
+func (f *Fake) handle(conn net.Conn) string {
+	r := bufio.NewReader(conn)
+	cmd, err := r.ReadString(0)
+	if err != nil {
+		return "COMMAND READ TIMED OUT ERROR"
+	}
+	if strings.TrimRight(cmd, "\x00") != "zINSTREAM" {
+		return "UNKNOWN COMMAND ERROR"
+	}
+
+	var data bytes.Buffer
+	for {
+		var size [4]byte
+		if _, err := io.ReadFull(r, size[:]); err != nil {
+			return "INSTREAM: Can't read chunk size ERROR"
+		}
+		n := int(binary.BigEndian.Uint32(size[:]))
+		if n == 0 {
+			break
+		}
+		if f.MaxLength > 0 && data.Len()+n > f.MaxLength {
+			return "INSTREAM size limit exceeded. ERROR"
+		}
+		if _, err := io.CopyN(&data, r, int64(n)); err != nil {
+			return "INSTREAM: Can't read chunk ERROR"
+		}
+	}
+
+	f.mu.Lock()
+	f.streams++
+	f.mu.Unlock()
+
+	err = live.EICARScanner{}.Scan(context.Background(), nil, &data)
+	if errors.Is(err, live.ErrUploadInfected) {
+		return "Eicar-Signature FOUND"
+	}
+	return "OK"
+}
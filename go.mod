@@ -2,7 +2,10 @@ module live-testing
 
 go 1.17
 
-require github.com/jfyne/live v0.14.1
+require (
+	github.com/jfyne/live v0.14.1
+	nhooyr.io/websocket v1.8.7
+)
 
 require (
 	github.com/google/go-cmp v0.5.6 // indirect
@@ -14,5 +17,4 @@ require (
 	github.com/rs/xid v1.3.0 // indirect
 	golang.org/x/net v0.0.0-20220105145211-5b0dc2dfae98 // indirect
 	golang.org/x/time v0.0.0-20211116232009-f0f3c7e86c11 // indirect
-	nhooyr.io/websocket v1.8.7 // indirect
 )
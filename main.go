@@ -3,21 +3,28 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"html/template"
 	"io"
-	"live-testing/fileutils"
+	"live-testing/clamd"
+	"live-testing/s3"
 	"log"
 	"net/http"
-	"path/filepath"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/jfyne/live"
 )
 
-func WithTemplateRenderer() live.HandlerConfig {
+func WithTemplateRenderer(funcs template.FuncMap) live.HandlerConfig {
 	return func(h live.Handler) error {
 		h.HandleRender(func(ctx context.Context, data interface{}) (io.Reader, error) {
-			t, err := template.ParseFiles("root.html", "buttons/view.html")
+			t, err := template.New("root.html").Funcs(funcs).ParseFiles("root.html", "buttons/view.html")
 			if err != nil {
 				log.Fatal(err)
 			}
@@ -36,9 +43,90 @@ const (
 	dec = "dec"
 )
 
+const (
+	// galleryLimit the number of uploads the gallery starts with.
+	galleryLimit = 20
+	// galleryLinkTTL how long links in the gallery work for. They are
+	// signed once, so the gallery's items never change once rendered.
+	galleryLinkTTL = 24 * time.Hour
+)
+
 type counter struct {
-	Value int
-	File  *live.UploadConfig
+	Value   int
+	File    *live.UploadConfig
+	Uploads []live.UploadRecord
+	Usage   live.UploadUsage
+	// Uploader the label this socket's session has in the gallery.
+	Uploader string
+	// Gallery the uploads in the shared gallery, newest first when
+	// mounted. The gallery is rendered with live-update="prepend", so
+	// after that it only holds the uploads to add to the top.
+	Gallery []galleryItem
+}
+
+// galleryItem an upload in the shared gallery.
+type galleryItem struct {
+	Ref       string
+	Name      string
+	Size      int
+	Thumbnail string
+	// Uploader a label for the session which uploaded the file.
+	Uploader string
+}
+
+// uploaderKey the key uploader labels are made with. It is random, so
+// a label can't be matched to the session ID it stands for.
+var uploaderKey = func() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		log.Fatal(err)
+	}
+	return key
+}()
+
+// uploaderLabel a short label for a session, which tells uploaders in
+// the gallery apart without showing everyone their session IDs.
+func uploaderLabel(sessionID string) string {
+	mac := hmac.New(sha256.New, uploaderKey)
+	mac.Write([]byte(sessionID))
+	return "uploader-" + hex.EncodeToString(mac.Sum(nil))[:8]
+}
+
+// newGalleryItems turn records into gallery items.
+func newGalleryItems(records []live.UploadRecord, files *live.UploadServer) []galleryItem {
+	items := make([]galleryItem, 0, len(records))
+	expires := time.Now().Add(galleryLinkTTL)
+	for _, r := range records {
+		thumbnail := r.Variant("thumbnail")
+		if thumbnail == "" && strings.HasPrefix(r.ContentType, "image/") {
+			thumbnail = r.Path
+		}
+		if thumbnail != "" {
+			thumbnail = files.Sign(thumbnail, expires)
+		}
+		items = append(items, galleryItem{
+			Ref:       r.Ref,
+			Name:      r.Name,
+			Size:      r.Size,
+			Thumbnail: thumbnail,
+			Uploader:  uploaderLabel(r.SessionID),
+		})
+	}
+	return items
+}
+
+// formatSize a number of bytes for people.
+func formatSize(n int) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := unit, 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTPE"[exp])
 }
 
 func newCounter(s live.Socket) *counter {
@@ -49,15 +137,102 @@ func newCounter(s live.Socket) *counter {
 	return c
 }
 
+// uploadOptions the options for the file upload. If S3_ENDPOINT is set
+// files are sent straight to the bucket instead of through the socket.
+func uploadOptions() (*s3.Presigner, []live.UploadOption) {
+	options := []live.UploadOption{
+		live.WithMaxEntries(3),
+		live.WithAccept(".png", ".jpg", ".jpeg", ".gif"),
+		live.WithMaxFileSize(10 << 20),
+		live.WithMaxTotalSize(20 << 20),
+		live.WithAutoUpload(),
+	}
+	endpoint := os.Getenv("S3_ENDPOINT")
+	if endpoint == "" {
+		return nil, options
+	}
+	presigner := s3.NewPresigner(s3.Config{
+		Endpoint:  endpoint,
+		Region:    os.Getenv("S3_REGION"),
+		Bucket:    os.Getenv("S3_BUCKET"),
+		AccessKey: os.Getenv("S3_ACCESS_KEY"),
+		SecretKey: os.Getenv("S3_SECRET_KEY"),
+	})
+	// Uploads are read back from the bucket and checked before they
+	// are done.
+	return presigner, append(options, live.WithExternal(presigner.PresignUpload), live.WithExternalChecker(presigner))
+}
+
+// uploadScanner the scanner for completed uploads. If CLAMD_ADDRESS is
+// set uploads are streamed to clamd, otherwise only the EICAR test
+// signature is looked for.
+func uploadScanner() live.Scanner {
+	address := os.Getenv("CLAMD_ADDRESS")
+	if address == "" {
+		return live.EICARScanner{}
+	}
+	return clamd.NewScanner("tcp", address)
+}
+
+// uploadServerOptions the options for serving uploads. If UPLOADS_SECRET
+// is set they can only be fetched with a signed URL.
+func uploadServerOptions() []live.UploadServerOption {
+	secret := os.Getenv("UPLOADS_SECRET")
+	if secret == "" {
+		return nil
+	}
+	return []live.UploadServerOption{live.WithSignedURLs([]byte(secret))}
+}
+
 func main() {
-	h := live.NewHandler(WithTemplateRenderer())
+	// Keep originals by content, so the same image uploaded twice is
+	// stored once, and collect the ones nothing refers to any more.
+	blobs, err := live.NewContentStore("public/uploads", "/uploads")
+	if err != nil {
+		log.Fatal(err)
+	}
+	files, err := live.NewUploadServer(blobs, uploadServerOptions()...)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Links are signed to expire at the end of the next hour, so they
+	// don't change between renders.
+	h := live.NewHandler(WithTemplateRenderer(template.FuncMap{
+		"signed": func(p string) string {
+			return files.Sign(p, time.Now().Truncate(time.Hour).Add(2*time.Hour))
+		},
+		"size": formatSize,
+	}))
+	presigner, options := uploadOptions()
+	images := live.NewImageProcessor("public/uploads", "/uploads")
+	images.Store = blobs
+	// Remember every consumed file, across restarts.
+	catalog, err := live.NewUploadCatalog("data/uploads.jsonl")
+	if err != nil {
+		log.Fatal(err)
+	}
+	mine := func(s live.Socket) []live.UploadRecord {
+		return catalog.List(live.UploadFilter{SessionID: live.SessionID(s.Session())})
+	}
+	go func() {
+		for range time.Tick(10 * time.Minute) {
+			if _, err := blobs.GC(); err != nil {
+				log.Println("content gc:", err)
+			}
+		}
+	}()
 
 	// Set the mount function for this handler.
 	h.HandleMount(func(ctx context.Context, s live.Socket) (interface{}, error) {
 		c := newCounter(s)
 		// build or return an uploadConfig and assign it to our file
-		uploadConfig := s.Upload("file")
+		uploadConfig := s.Upload("file", options...)
 		c.File = uploadConfig
+		c.Usage = s.UploadUsage()
+		c.Uploads = mine(s)
+		c.Uploader = uploaderLabel(live.SessionID(s.Session()))
+		c.Gallery = newGalleryItems(catalog.List(live.UploadFilter{Limit: galleryLimit}), files)
 
 		// This will initialise the counter if needed.
 		return c, nil
@@ -97,6 +272,13 @@ func main() {
 		return c, nil
 	})
 
+	// Upload progress, called as chunks arrive rather than on every one.
+	h.HandleUploadProgress("file", func(ctx context.Context, s live.Socket, entry *live.UploadEntry) (interface{}, error) {
+		c := newCounter(s)
+		c.Usage = s.UploadUsage()
+		return c, nil
+	})
+
 	// was thinking this might be a good escape hatch...
 	// h.HandleEvent("allow_upload", func(ctx context.Context, s live.Socket, p live.Params) (interface{}, error) {
 	// 	// log.Println(EventUpload)
@@ -112,28 +294,63 @@ func main() {
 		// build or return an uploadConfig and assign it to our file
 		c.File = s.Upload("file")
 
-		pubPath := s.UploadConsume("file", func(path string) string {
-			fmt.Printf("Processing upload: %s at path: %s with original name as: %s\n", "file", path, c.File.OrignalName)
+		consumed := s.UploadConsume("file", func(entry *live.UploadEntry, r io.Reader) (string, error) {
+			fmt.Printf("Processing upload: %s at key: %s with original name as: %s (%s, %d bytes) and sha256: %s\n", "file", entry.Key, entry.Name, entry.Type, entry.Size, entry.SHA256)
 
-			dest := filepath.Join("public/uploads", filepath.Base(path))
-			err := fileutils.CopyFile(path, dest)
-			if err != nil {
-				panic(err)
+			// Files sent to the bucket are already where they need to be.
+			if entry.External != nil {
+				u, err := presigner.ObjectURL(entry.Key)
+				if err != nil {
+					return "", err
+				}
+				return u.String(), nil
 			}
 
-			// dest = Path.join("priv/static/uploads", Path.basename(path))
-			// File.cp!(path, dest)
-			// Routes.static_path(socket, "/uploads/#{Path.basename(dest)}")
-
-			return filepath.Join("/uploads", filepath.Base(dest))
+			// Copy the original to public/uploads along with a
+			// thumbnail and medium sized variant.
+			return images.Process(entry, r)
 		})
 
-		fmt.Printf("consumed: %s\n", *pubPath)
+		records, err := catalog.Record(s, consumed.Consumed)
+		if err != nil {
+			log.Println("could not catalog uploads:", err)
+		}
+		for _, r := range records {
+			fmt.Printf("consumed: %s (%s, %s, %d bytes) to %s\n", r.Ref, r.Name, r.ContentType, r.Size, r.Path)
+		}
+		for _, entry := range consumed.Failed {
+			fmt.Printf("failed: %s: %s\n", entry.Name, entry.Error)
+		}
+		c.Uploads = mine(s)
+		c.Usage = s.UploadUsage()
+
+		// Every socket, this one included, adds the new uploads to its
+		// gallery.
+		if len(records) > 0 {
+			if err := s.Broadcast("newupload", newGalleryItems(records, files)); err != nil {
+				return c, fmt.Errorf("failed broadcasting new upload: %w", err)
+			}
+		}
 
-		// if err := s.Broadcast("newmessage", c); err != nil {
-		// 	return c, fmt.Errorf("failed broadcasting new messaage: %w", err)
-		// }
+		return c, nil
+	})
 
+	// Delete one of this session's uploads. The file itself is removed
+	// by the content store's GC once nothing else refers to it.
+	h.HandleEvent("delete-upload", func(ctx context.Context, s live.Socket, p live.Params) (interface{}, error) {
+		c := newCounter(s)
+		ref := p.String("ref")
+		if r, ok := catalog.Get(ref); ok && r.SessionID == live.SessionID(s.Session()) {
+			if _, err := catalog.Delete(ref); err != nil {
+				return c, err
+			}
+			if _, ok := blobs.Blob(r.SHA256); ok && strings.HasPrefix(r.Path, "/uploads/") {
+				if err := blobs.Release(r.SHA256); err != nil {
+					log.Println("could not release upload:", err)
+				}
+			}
+		}
+		c.Uploads = mine(s)
 		return c, nil
 	})
 
@@ -152,17 +369,35 @@ func main() {
 		// loads of memory. `live-update="append"` handles the appending
 		// of messages in the DOM.
 		// m.Messages = []Message{NewMessage(data)}
-		c, ok := data.(*counter)
-		if !ok {
-			c = newCounter(s)
+		// Only the value is shared, the rest of the counter belongs
+		// to the socket which sent it.
+		c := newCounter(s)
+		if m, ok := data.(*counter); ok {
+			c.Value = m.Value
 		}
 		c.File = s.Upload("file")
-		// c.Value = q
+		return c, nil
+	})
+
+	h.HandleSelf("newupload", func(ctx context.Context, s live.Socket, data interface{}) (interface{}, error) {
+		// The gallery only holds the new uploads, `live-update="prepend"`
+		// adds them to the top of what is already in the DOM.
+		c := newCounter(s)
+		if items, ok := data.([]galleryItem); ok {
+			c.Gallery = items
+		}
 		return c, nil
 	})
 
 	// Run the server.
-	http.Handle("/", live.NewHttpHandler(live.NewCookieStore("session-name", []byte("weak-secret")), h))
+	http.Handle("/", live.NewHttpHandler(
+		live.NewCookieStore("session-name", []byte("weak-secret")),
+		h,
+		live.WithUploadStore(live.NewLocalUploadStore("tmp/uploads")),
+		live.WithUploadScanner(uploadScanner()),
+		live.WithUploadQuota(100<<20, 50, time.Hour),
+		live.WithUploadStoreBudget(1<<30),
+	))
 	// http.HandleFunc("/live.js", func(w http.ResponseWriter, r *http.Request) {
 	// 	http.ServeFile(w, r, "./vendor/web/browser/auto.js")
 	// })
@@ -173,7 +408,7 @@ func main() {
 	// http.Handle("/auto.js.map", http.FileServer(http.Dir("./vendor/web/browser")))
 	// http.Handle("/upload", media.Media{})
 
-	http.Handle("/uploads/", http.FileServer(http.Dir("./public")))
+	http.Handle("/uploads/", files)
 
 	fmt.Println("starting on :8080")
 	http.ListenAndServe(":8080", nil)
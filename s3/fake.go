@@ -0,0 +1,158 @@
+package s3
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Fake a minimal S3 compatible server for tests. It checks presigned
+// URLs are signed with its credentials and have not expired, and keeps
+// objects in memory.
+type Fake struct {
+	// Server the running test server.
+	Server *httptest.Server
+
+	accessKey string
+	secretKey string
+	region    string
+
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+// NewFake start a fake server accepting the given credentials. Close
+// it with Close.
+func NewFake(accessKey, secretKey, region string) *Fake {
+	f := &Fake{
+		accessKey: accessKey,
+		secretKey: secretKey,
+		region:    region,
+		objects:   make(map[string][]byte),
+	}
+	f.Server = httptest.NewServer(f)
+	return f
+}
+
+// Config returns a config pointing at this server.
+func (f *Fake) Config(bucket string) Config {
+	return Config{
+		Endpoint:  f.Server.URL,
+		Region:    f.region,
+		Bucket:    bucket,
+		AccessKey: f.accessKey,
+		SecretKey: f.secretKey,
+	}
+}
+
+// Object returns the contents of an object, bucket/key.
+func (f *Fake) Object(path string) ([]byte, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	data, ok := f.objects[path]
+	return data, ok
+}
+
+// Close shut the server down.
+func (f *Fake) Close() {
+	f.Server.Close()
+}
+
+// ServeHTTP handle a presigned request.
+func (f *Fake) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Browsers upload straight to the bucket, so allow them to.
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, PUT, HEAD")
+	w.Header().Set("Access-Control-Allow-Headers", "*")
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if err := f.verify(r); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	switch r.Method {
+	case http.MethodPut:
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.mu.Lock()
+		f.objects[path] = data
+		f.mu.Unlock()
+		w.Header().Set("ETag", `"`+hexSHA256(data)+`"`)
+		w.WriteHeader(http.StatusOK)
+	case http.MethodGet, http.MethodHead:
+		data, ok := f.Object(path)
+		if !ok {
+			http.Error(w, "NoSuchKey", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// verify check the presigned signature of a request.
+func (f *Fake) verify(r *http.Request) error {
+	q := r.URL.Query()
+	sig := q.Get("X-Amz-Signature")
+	if sig == "" {
+		return fmt.Errorf("missing signature")
+	}
+	q.Del("X-Amz-Signature")
+
+	credential := strings.SplitN(q.Get("X-Amz-Credential"), "/", 2)
+	if len(credential) != 2 || credential[0] != f.accessKey {
+		return fmt.Errorf("unknown access key")
+	}
+	t, err := time.Parse(amzDateFormat, q.Get("X-Amz-Date"))
+	if err != nil {
+		return fmt.Errorf("invalid date: %w", err)
+	}
+	expires, err := strconv.Atoi(q.Get("X-Amz-Expires"))
+	if err != nil {
+		return fmt.Errorf("invalid expires: %w", err)
+	}
+	if time.Now().After(t.Add(time.Duration(expires) * time.Second)) {
+		return fmt.Errorf("request has expired")
+	}
+
+	// Signed headers must be sent with the values they were signed
+	// with, the body's length included.
+	headers := map[string]string{}
+	for _, name := range strings.Split(q.Get("X-Amz-SignedHeaders"), ";") {
+		switch name {
+		case "host":
+			headers[name] = r.Host
+		case "content-length":
+			headers[name] = strconv.FormatInt(r.ContentLength, 10)
+		default:
+			headers[name] = r.Header.Get(name)
+		}
+	}
+	if _, ok := headers["host"]; !ok {
+		return fmt.Errorf("host is not signed")
+	}
+
+	expected := signature(f.secretKey, f.region, t, r.Method, r.URL.EscapedPath(), q, headers)
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(sig)) != 1 {
+		return fmt.Errorf("signature does not match")
+	}
+	return nil
+}
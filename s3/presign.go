@@ -0,0 +1,279 @@
+package s3
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jfyne/live"
+)
+
+const (
+	// algorithm the signing algorithm used by SigV4.
+	algorithm = "AWS4-HMAC-SHA256"
+	// service the service name used in the credential scope.
+	service = "s3"
+	// unsignedPayload presigned URLs don't sign the body.
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+	// amzDateFormat the format of X-Amz-Date.
+	amzDateFormat = "20060102T150405Z"
+	// scopeDateFormat the format of the date in the credential scope.
+	scopeDateFormat = "20060102"
+)
+
+// Config describes an S3 compatible bucket.
+type Config struct {
+	// Endpoint the base URL of the service, for example
+	// http://localhost:9000 for a local MinIO.
+	Endpoint string
+	// Region the region of the bucket, us-east-1 for MinIO.
+	Region string
+	// Bucket the bucket to upload to.
+	Bucket string
+	// AccessKey the access key ID to sign with.
+	AccessKey string
+	// SecretKey the secret access key to sign with.
+	SecretKey string
+	// Prefix added to every object key.
+	Prefix string
+	// Expires how long presigned URLs are valid for, 15 minutes if zero.
+	Expires time.Duration
+}
+
+var _ live.ExternalChecker = &Presigner{}
+
+// Presigner creates SigV4 presigned URLs. Objects are addressed path
+// style, endpoint/bucket/key, which MinIO and most S3 compatible stores
+// accept.
+type Presigner struct {
+	config Config
+	now    func() time.Time
+}
+
+// NewPresigner create a presigner for a bucket.
+func NewPresigner(c Config) *Presigner {
+	if c.Expires == 0 {
+		c.Expires = 15 * time.Minute
+	}
+	if c.Region == "" {
+		c.Region = "us-east-1"
+	}
+	return &Presigner{config: c, now: time.Now}
+}
+
+// ObjectURL returns the unsigned URL of an object.
+func (p *Presigner) ObjectURL(key string) (*url.URL, error) {
+	u, err := url.Parse(p.config.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid endpoint: %w", err)
+	}
+	u.Path = "/" + p.config.Bucket + "/" + key
+	u.RawPath = "/" + p.config.Bucket + "/" + encodePath(key)
+	return u, nil
+}
+
+// Presign returns a URL which allows method on the object key until
+// it expires.
+func (p *Presigner) Presign(method, key string) (string, error) {
+	return p.presign(method, key, nil)
+}
+
+// presign returns a URL which allows method on the object key until it
+// expires, only when sent with the given headers. Header names must be
+// lower case.
+func (p *Presigner) presign(method, key string, headers map[string]string) (string, error) {
+	u, err := p.ObjectURL(key)
+	if err != nil {
+		return "", err
+	}
+	signed := map[string]string{"host": u.Host}
+	for name, value := range headers {
+		signed[name] = value
+	}
+
+	now := p.now().UTC()
+	scope := strings.Join([]string{now.Format(scopeDateFormat), p.config.Region, service, "aws4_request"}, "/")
+
+	q := url.Values{}
+	q.Set("X-Amz-Algorithm", algorithm)
+	q.Set("X-Amz-Credential", p.config.AccessKey+"/"+scope)
+	q.Set("X-Amz-Date", now.Format(amzDateFormat))
+	q.Set("X-Amz-Expires", fmt.Sprintf("%d", int(p.config.Expires/time.Second)))
+	q.Set("X-Amz-SignedHeaders", signedHeaders(signed))
+
+	sig := signature(p.config.SecretKey, p.config.Region, now, method, u.EscapedPath(), q, signed)
+	u.RawQuery = canonicalQuery(q) + "&X-Amz-Signature=" + sig
+	return u.String(), nil
+}
+
+// PresignUpload presigns a PUT for an upload entry. Use it with
+// live.WithExternal. The PUT must have the entry's size and type, so
+// the bucket only accepts the file the server allowed.
+func (p *Presigner) PresignUpload(ctx context.Context, entry *live.UploadEntry) (*live.ExternalUpload, error) {
+	key := p.config.Prefix + entry.Key
+	signed := map[string]string{"content-length": strconv.Itoa(entry.Size)}
+	headers := map[string]string{}
+	if entry.Type != "" {
+		signed["content-type"] = entry.Type
+		headers["Content-Type"] = entry.Type
+	}
+	signedURL, err := p.presign("PUT", key, signed)
+	if err != nil {
+		return nil, err
+	}
+	return &live.ExternalUpload{
+		URL:     signedURL,
+		Method:  "PUT",
+		Headers: headers,
+		Key:     key,
+	}, nil
+}
+
+// Size returns the size of an object with a HEAD request. Along with
+// Open it lets live.WithExternalChecker check uploaded entries.
+func (p *Presigner) Size(ctx context.Context, key string) (int64, error) {
+	res, err := p.do(ctx, http.MethodHead, key)
+	if err != nil {
+		return 0, err
+	}
+	res.Body.Close()
+	if res.ContentLength < 0 {
+		return 0, fmt.Errorf("no size for %s", key)
+	}
+	return res.ContentLength, nil
+}
+
+// Open read an object.
+func (p *Presigner) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	res, err := p.do(ctx, http.MethodGet, key)
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+// do send a presigned request for an object, failing unless it
+// succeeds.
+func (p *Presigner) do(ctx context.Context, method, key string) (*http.Response, error) {
+	signed, err := p.Presign(method, key)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, signed, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, fmt.Errorf("%s %s: %s", method, key, res.Status)
+	}
+	return res, nil
+}
+
+// signature compute the SigV4 signature of a presigned request, signing
+// headers, which are keyed by their lower case names.
+func signature(secret, region string, t time.Time, method, path string, q url.Values, headers map[string]string) string {
+	canonicalHeaders := ""
+	for _, name := range strings.Split(signedHeaders(headers), ";") {
+		canonicalHeaders += name + ":" + strings.TrimSpace(headers[name]) + "\n"
+	}
+	canonicalRequest := strings.Join([]string{
+		method,
+		path,
+		canonicalQuery(q),
+		canonicalHeaders,
+		signedHeaders(headers),
+		unsignedPayload,
+	}, "\n")
+
+	scope := strings.Join([]string{t.Format(scopeDateFormat), region, service, "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{
+		algorithm,
+		t.Format(amzDateFormat),
+		scope,
+		hexSHA256([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+secret), t.Format(scopeDateFormat))
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+// signedHeaders the sorted names of the signed headers, as SigV4
+// lists them.
+func signedHeaders(headers map[string]string) string {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ";")
+}
+
+// canonicalQuery encode query parameters sorted by key, as SigV4 expects.
+func canonicalQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := []string{}
+	for _, k := range keys {
+		vals := append([]string{}, q[k]...)
+		sort.Strings(vals)
+		for _, v := range vals {
+			parts = append(parts, encode(k)+"="+encode(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// encodePath URI encode each segment of a path.
+func encodePath(p string) string {
+	segments := strings.Split(p, "/")
+	for i, s := range segments {
+		segments[i] = encode(s)
+	}
+	return strings.Join(segments, "/")
+}
+
+// encode URI encode a string the way SigV4 expects, which differs from
+// net/url in how it treats spaces and reserved characters.
+func encode(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') || c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func hexSHA256(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,168 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jfyne/live"
+)
+
+func do(t *testing.T, method, url string, body []byte, headers ...map[string]string) (int, []byte) {
+	t.Helper()
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, h := range headers {
+		for name, value := range h {
+			req.Header.Set(name, value)
+		}
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.StatusCode, data
+}
+
+func TestPresignUpload(t *testing.T) {
+	fake := NewFake("AKID", "secret", "eu-west-2")
+	defer fake.Close()
+	p := NewPresigner(fake.Config("bucket"))
+
+	keys := []string{"a.png", "dir/with space+plus.jpg", "ünïcode ☃.txt"}
+	for _, key := range keys {
+		t.Run(key, func(t *testing.T) {
+			up, err := p.PresignUpload(context.Background(), &live.UploadEntry{Key: key, Size: 5, Type: "text/plain"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if code, body := do(t, up.Method, up.URL, []byte("hello"), up.Headers); code != http.StatusOK {
+				t.Fatalf("put: got %d %s", code, body)
+			}
+			data, ok := fake.Object("bucket/" + key)
+			if !ok || string(data) != "hello" {
+				t.Fatalf("object not stored, got %q", data)
+			}
+
+			get, err := p.Presign("GET", key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if code, body := do(t, "GET", get, nil); code != http.StatusOK || string(body) != "hello" {
+				t.Fatalf("get: got %d %s", code, body)
+			}
+
+			size, err := p.Size(context.Background(), key)
+			if err != nil || size != 5 {
+				t.Fatalf("got size %d, %v", size, err)
+			}
+			r, err := p.Open(context.Background(), key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+			if data, err := io.ReadAll(r); err != nil || string(data) != "hello" {
+				t.Fatalf("opened %q, %v", data, err)
+			}
+		})
+	}
+
+	if _, err := p.Size(context.Background(), "missing"); err == nil {
+		t.Fatal("got the size of a missing object")
+	}
+	if _, err := p.Open(context.Background(), "missing"); err == nil {
+		t.Fatal("opened a missing object")
+	}
+}
+
+// TestPresignUploadRejected the bucket only accepts the file the server
+// allowed, of the declared size and type.
+func TestPresignUploadRejected(t *testing.T) {
+	fake := NewFake("AKID", "secret", "us-east-1")
+	defer fake.Close()
+	p := NewPresigner(fake.Config("bucket"))
+	up, err := p.PresignUpload(context.Background(), &live.UploadEntry{Key: "a.png", Size: 5, Type: "image/png"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		body    string
+		headers map[string]string
+	}{
+		{name: "larger", body: "hello world", headers: up.Headers},
+		{name: "smaller", body: "hell", headers: up.Headers},
+		{name: "other type", body: "hello", headers: map[string]string{"Content-Type": "text/html"}},
+		{name: "no type", body: "hello"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if code, body := do(t, up.Method, up.URL, []byte(tt.body), tt.headers); code != http.StatusForbidden {
+				t.Fatalf("got %d %s, want 403", code, body)
+			}
+		})
+	}
+	if _, ok := fake.Object("bucket/a.png"); ok {
+		t.Fatal("rejected upload stored an object")
+	}
+}
+
+func TestPresignRejected(t *testing.T) {
+	fake := NewFake("AKID", "secret", "us-east-1")
+	defer fake.Close()
+	p := NewPresigner(fake.Config("bucket"))
+	signed, err := p.Presign("PUT", "a.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expired := NewPresigner(fake.Config("bucket"))
+	expired.now = func() time.Time { return time.Now().Add(-time.Hour) }
+	expiredURL, err := expired.Presign("PUT", "a.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wrong := fake.Config("bucket")
+	wrong.SecretKey = "not-the-secret"
+	wrongURL, err := NewPresigner(wrong).Presign("PUT", "a.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		url    string
+	}{
+		{name: "other key", method: "PUT", url: strings.Replace(signed, "a.png", "b.png", 1)},
+		{name: "other method", method: "DELETE", url: signed},
+		{name: "tampered signature", method: "PUT", url: signed[:len(signed)-4] + "0000"},
+		{name: "tampered expiry", method: "PUT", url: strings.Replace(signed, "X-Amz-Expires=900", "X-Amz-Expires=9000", 1)},
+		{name: "no signature", method: "PUT", url: signed[:strings.Index(signed, "&X-Amz-Signature")]},
+		{name: "expired", method: "PUT", url: expiredURL},
+		{name: "wrong secret", method: "PUT", url: wrongURL},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if code, body := do(t, tt.method, tt.url, []byte("x")); code != http.StatusForbidden {
+				t.Fatalf("got %d %s, want 403", code, body)
+			}
+		})
+	}
+	if _, ok := fake.Object("bucket/a.png"); ok {
+		t.Fatal("rejected request stored an object")
+	}
+}